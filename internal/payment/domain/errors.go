@@ -0,0 +1,60 @@
+package domain
+
+import "errors"
+
+var (
+	// ErrInsufficientFunds is returned by Reserve when the customer's
+	// available balance is smaller than the requested amount.
+	ErrInsufficientFunds = errors.New(`saga: insufficient funds`)
+
+	// ErrPaymentNotFound is returned by Complete/Cancel when the referenced
+	// payment does not exist.
+	ErrPaymentNotFound = errors.New(`saga: payment not found`)
+
+	// ErrCompletedPayment is returned when an event tries to mutate a
+	// payment that has already been completed.
+	ErrCompletedPayment = errors.New(`saga: payment already completed`)
+
+	// ErrCanceledPayment is returned when an event tries to mutate a
+	// payment that has already been canceled.
+	ErrCanceledPayment = errors.New(`saga: payment already canceled`)
+
+	// ErrUnknownEvent is returned by PersistTransaction for an event type
+	// it does not know how to apply.
+	ErrUnknownEvent = errors.New(`saga: unknown event`)
+
+	// ErrIdempotencyConflict is returned when an idempotency key is reused
+	// with a request that does not match the one it was first seen with.
+	ErrIdempotencyConflict = errors.New(`saga: idempotency key conflict`)
+
+	// ErrIdempotencyInProgress is returned when an idempotency key's first
+	// request has been claimed but has not finished recording its result
+	// yet, so there is nothing to replay.
+	ErrIdempotencyInProgress = errors.New(`saga: idempotency key in progress`)
+
+	// ErrRateStale is returned by Reserve when the FXProvider's quote is
+	// older than the configured freshness window.
+	ErrRateStale = errors.New(`saga: fx rate is stale`)
+
+	// ErrFXProviderRequired is returned by Reserve when it needs to convert
+	// between currencies but no FXProvider has been configured.
+	ErrFXProviderRequired = errors.New(`saga: fx provider required for cross-currency reserve`)
+
+	// ErrInsufficientApprovals is returned by Complete when a payment is
+	// pending multi-signature approval and has not yet collected enough
+	// distinct approver signatures.
+	ErrInsufficientApprovals = errors.New(`saga: insufficient approvals`)
+
+	// ErrUnknownApprover is returned by Approve when ApproverID is not
+	// registered as an approver for the payment's customer.
+	ErrUnknownApprover = errors.New(`saga: unknown approver`)
+
+	// ErrInvalidSignature is returned by Approve when Signature does not
+	// verify against the approver's registered public key.
+	ErrInvalidSignature = errors.New(`saga: invalid approval signature`)
+
+	// ErrLedgerBalanceMismatch is returned when a customer's balances row
+	// disagrees with the sum of their ledger_entries postings, meaning the
+	// two have drifted and the balance can no longer be trusted.
+	ErrLedgerBalanceMismatch = errors.New(`saga: balance does not reconcile with ledger`)
+)
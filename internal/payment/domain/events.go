@@ -0,0 +1,62 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Event is a command accepted by repository.PersistTransaction that drives
+// a payment through the saga.
+type Event interface {
+	isEvent()
+}
+
+// Reserve opens a payment and moves funds from available into reserved. If
+// TTL is positive, the reservation expires after it and the expirer
+// subsystem auto-cancels it, releasing the funds back to available. Only
+// payments still in the reserved status are expired; a payment pending
+// approval is not auto-cancelled.
+//
+// Currency is the currency Amount is denominated in. SettlementCurrency,
+// if set, is the currency the customer's balance is actually held and
+// debited in; when it differs from Currency, the repository converts
+// Amount using a locked FXProvider quote before touching the balance.
+// SettlementCurrency defaults to Currency when empty.
+type Reserve struct {
+	OrderID            uuid.UUID
+	Amount             decimal.Decimal
+	Currency           string
+	SettlementCurrency string
+	TTL                time.Duration
+}
+
+func (Reserve) isEvent() {}
+
+// Complete settles a reserved payment, moving its funds out of reserved.
+type Complete struct {
+	PaymentID uuid.UUID
+}
+
+func (Complete) isEvent() {}
+
+// Cancel releases a reserved payment, returning its funds to available.
+type Cancel struct {
+	PaymentID uuid.UUID
+}
+
+func (Cancel) isEvent() {}
+
+// Approve records a signed approval for a payment awaiting multi-signature
+// sign-off because its amount exceeds the customer's approval threshold.
+// Signature must verify against ApproverID's registered Ed25519 public key
+// over the payment id. Once enough distinct approvers have signed, a
+// subsequent Complete is allowed to proceed.
+type Approve struct {
+	PaymentID  uuid.UUID
+	ApproverID uuid.UUID
+	Signature  []byte
+}
+
+func (Approve) isEvent() {}
@@ -0,0 +1,21 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// FXQuote is an exchange rate locked at a point in time. The repository
+// rejects a quote once it is older than its configured freshness window.
+type FXQuote struct {
+	Rate decimal.Decimal
+	AsOf time.Time
+}
+
+// FXProvider supplies the conversion rate used when a Reserve's currency
+// differs from the currency its funds are settled in.
+type FXProvider interface {
+	Rate(ctx context.Context, from, to string) (FXQuote, error)
+}
@@ -0,0 +1,19 @@
+package domain
+
+import "context"
+
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey attaches key to ctx so that PersistTransaction treats
+// the call as retry-safe: replaying the same key with the same event
+// returns the cached result instead of applying the event again.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+// IdempotencyKeyFromContext returns the key attached by WithIdempotencyKey,
+// if any.
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyCtx{}).(string)
+	return key, ok
+}
@@ -0,0 +1,20 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Posting is a single signed entry in the double-entry ledger that backs a
+// Balance. A Reserve/Complete/Cancel writes a pair of postings whose
+// amounts sum to zero, debiting one account and crediting another.
+type Posting struct {
+	ID            uuid.UUID
+	TransactionID uuid.UUID
+	Account       string
+	Amount        decimal.Decimal
+	PaymentID     uuid.UUID
+	CreatedAt     time.Time
+}
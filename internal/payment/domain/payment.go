@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Payment is a handle to a payment record produced by a mutation on the
+// saga, returned so callers can thread the id into the next event without
+// re-querying storage.
+type Payment interface {
+	GetID() uuid.UUID
+}
+
+// NewPayment is returned by PersistTransaction when a Reserve event creates
+// a payment for the first time.
+type NewPayment struct {
+	ID uuid.UUID
+}
+
+func (p NewPayment) GetID() uuid.UUID { return p.ID }
+
+// ExistingPayment is returned by PersistTransaction when an event transitions
+// an already persisted payment.
+type ExistingPayment struct {
+	ID uuid.UUID
+}
+
+func (p ExistingPayment) GetID() uuid.UUID { return p.ID }
+
+// Balance is the customer's available and reserved funds in a single
+// currency; a customer may hold a Balance per currency.
+type Balance struct {
+	CustomerID uuid.UUID
+	Currency   string
+	Amount     decimal.Decimal
+	Reserved   decimal.Decimal
+}
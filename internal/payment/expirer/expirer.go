@@ -0,0 +1,85 @@
+// Package expirer periodically auto-cancels reservations whose TTL has
+// elapsed, releasing their reserved funds back to available.
+package expirer
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/moeryomenko/saga/internal/payment/infrastructure/repository"
+)
+
+// Expirer polls repository.ExpireReservations on an interval.
+type Expirer struct {
+	log zerolog.Logger
+
+	batchSize    int
+	pollInterval time.Duration
+	maxBackoff   time.Duration
+}
+
+// Option configures an Expirer.
+type Option func(*Expirer)
+
+// WithBatchSize sets how many expired reservations are claimed per tick.
+// Defaults to 20.
+func WithBatchSize(n int) Option {
+	return func(e *Expirer) { e.batchSize = n }
+}
+
+// WithPollInterval sets the steady-state delay between ticks. Defaults to
+// one second.
+func WithPollInterval(interval time.Duration) Option {
+	return func(e *Expirer) { e.pollInterval = interval }
+}
+
+// WithMaxBackoff caps the exponential backoff applied after a failed tick.
+// Defaults to 30 seconds.
+func WithMaxBackoff(max time.Duration) Option {
+	return func(e *Expirer) { e.maxBackoff = max }
+}
+
+// New builds an Expirer.
+func New(log zerolog.Logger, opts ...Option) *Expirer {
+	e := &Expirer{
+		log:          log,
+		batchSize:    20,
+		pollInterval: time.Second,
+		maxBackoff:   30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Run ticks until ctx is canceled, backing off exponentially after a
+// transient DB error.
+func (e *Expirer) Run(ctx context.Context) {
+	backoff := e.pollInterval
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		expired, err := repository.ExpireReservations(ctx, e.batchSize)
+		if err != nil {
+			e.log.Error().Err(err).Msg(`expirer: tick failed`)
+			backoff *= 2
+			if backoff > e.maxBackoff {
+				backoff = e.maxBackoff
+			}
+			continue
+		}
+		if expired > 0 {
+			e.log.Info().Int(`count`, expired).Msg(`expirer: auto-cancelled expired reservations`)
+		}
+
+		backoff = e.pollInterval
+	}
+}
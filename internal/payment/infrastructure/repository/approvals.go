@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"crypto/ed25519"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+
+	"github.com/moeryomenko/saga/internal/payment/domain"
+)
+
+const selectApprovalPolicyQuery = `
+SELECT threshold, required_approvals FROM customer_approval_policies WHERE customer_id = $1`
+
+const selectApproverKeyQuery = `
+SELECT public_key FROM customer_approvers WHERE customer_id = $1 AND approver_id = $2`
+
+const insertPaymentApprovalQuery = `
+INSERT INTO payment_approvals(payment_id, approver_id, signature) VALUES ($1, $2, $3)
+ON CONFLICT (payment_id, approver_id) DO NOTHING`
+
+const countPaymentApprovalsQuery = `
+SELECT count(*) FROM payment_approvals WHERE payment_id = $1`
+
+// approvalPolicy is a customer's multi-signature policy: reservations whose
+// settled amount exceeds Threshold enter statusPendingApproval and require
+// RequiredApprovals distinct approver signatures before Complete succeeds.
+type approvalPolicy struct {
+	Threshold         decimal.Decimal
+	RequiredApprovals int
+}
+
+// approvalPolicyFor returns customerID's approval policy, or ok=false if
+// the customer has none configured, in which case none of their payments
+// ever require approval.
+func approvalPolicyFor(ctx context.Context, tx pgx.Tx, customerID uuid.UUID) (policy approvalPolicy, ok bool, err error) {
+	err = tx.QueryRow(ctx, selectApprovalPolicyQuery, customerID).Scan(&policy.Threshold, &policy.RequiredApprovals)
+	if err == pgx.ErrNoRows {
+		return approvalPolicy{}, false, nil
+	}
+	return policy, err == nil, err
+}
+
+// approve verifies event's signature against ApproverID's registered
+// Ed25519 public key and, if it checks out, records the approval. A
+// re-signing by the same approver is a no-op rather than an error.
+func approve(ctx context.Context, customerID uuid.UUID, event domain.Approve, idemKey string) (domain.Payment, error) {
+	err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+		payment, err := findPaymentForUpdate(ctx, tx, event.PaymentID)
+		if err != nil {
+			return err
+		}
+
+		var publicKey []byte
+		err = tx.QueryRow(ctx, selectApproverKeyQuery, payment.CustomerID, event.ApproverID).Scan(&publicKey)
+		if err == pgx.ErrNoRows {
+			return domain.ErrUnknownApprover
+		}
+		if err != nil {
+			return err
+		}
+
+		if !ed25519.Verify(ed25519.PublicKey(publicKey), []byte(event.PaymentID.String()), event.Signature) {
+			return domain.ErrInvalidSignature
+		}
+
+		if _, err := tx.Exec(ctx, insertPaymentApprovalQuery, event.PaymentID, event.ApproverID, event.Signature); err != nil {
+			return err
+		}
+
+		if idemKey != `` {
+			return recordIdempotentResponse(ctx, tx, idemKey, domain.ExistingPayment{ID: event.PaymentID})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return domain.ExistingPayment{ID: event.PaymentID}, nil
+}
+
+// hasSufficientApprovals reports whether paymentID has collected at least
+// required distinct approver signatures.
+func hasSufficientApprovals(ctx context.Context, tx pgx.Tx, paymentID uuid.UUID, required int) (bool, error) {
+	var count int
+	if err := tx.QueryRow(ctx, countPaymentApprovalsQuery, paymentID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count >= required, nil
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+
+	"github.com/moeryomenko/saga/internal/payment/domain"
+)
+
+const selectExpiredReservationsQuery = `
+SELECT id, customer_id FROM payments
+WHERE status = $1 AND expires_at IS NOT NULL AND expires_at < now()
+ORDER BY expires_at
+LIMIT $2`
+
+const tryAdvisoryLockQuery = `SELECT pg_try_advisory_lock(hashtextextended($1::text, 0))`
+const advisoryUnlockQuery = `SELECT pg_advisory_unlock(hashtextextended($1::text, 0))`
+
+// expiredReservation identifies a reservation whose TTL has elapsed.
+type expiredReservation struct {
+	PaymentID  uuid.UUID
+	CustomerID uuid.UUID
+}
+
+// ExpireReservations scans for up to limit reservations whose TTL has
+// elapsed and auto-cancels each through the same Cancel path PersistTransaction
+// uses, releasing their reserved funds back to available. Each cancellation
+// is guarded by a Postgres advisory lock keyed on the payment id, so
+// multiple replicas polling concurrently don't race to cancel the same
+// reservation twice. It returns how many reservations were cancelled.
+func ExpireReservations(ctx context.Context, limit int) (int, error) {
+	rows, err := pool.Query(ctx, selectExpiredReservationsQuery, statusReserved, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var reservations []expiredReservation
+	for rows.Next() {
+		var r expiredReservation
+		if err := rows.Scan(&r.PaymentID, &r.CustomerID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reservations = append(reservations, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, r := range reservations {
+		ok, err := expireOne(ctx, r)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func expireOne(ctx context.Context, r expiredReservation) (bool, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, tryAdvisoryLockQuery, r.PaymentID).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		// another replica already owns this reservation's cancellation.
+		return false, nil
+	}
+	defer conn.Exec(ctx, advisoryUnlockQuery, r.PaymentID)
+
+	_, err = cancel(ctx, conn, r.CustomerID, domain.Cancel{PaymentID: r.PaymentID}, ``)
+	if err == domain.ErrCanceledPayment || err == domain.ErrCompletedPayment {
+		// settled elsewhere since the scan; nothing was cancelled here.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
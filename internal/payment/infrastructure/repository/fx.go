@@ -0,0 +1,24 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/moeryomenko/saga/internal/payment/domain"
+)
+
+var (
+	fxProvider          domain.FXProvider
+	rateFreshnessWindow = 5 * time.Minute
+)
+
+// SetFXProvider injects the FXProvider used to convert a Reserve's amount
+// when its currency differs from the customer's settlement currency.
+func SetFXProvider(provider domain.FXProvider) {
+	fxProvider = provider
+}
+
+// SetRateFreshnessWindow sets how old an FXProvider quote may be before
+// Reserve rejects it with domain.ErrRateStale. Defaults to 5 minutes.
+func SetRateFreshnessWindow(window time.Duration) {
+	rateFreshnessWindow = window
+}
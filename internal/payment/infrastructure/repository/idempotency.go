@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/moeryomenko/saga/internal/payment/domain"
+)
+
+// idempotencyClaimMaxAge bounds how long a claim may sit with response IS
+// NULL before it's considered abandoned (the process that claimed it died,
+// or its ctx was canceled, between inserting the claim and recording the
+// applyEvent result) and is eligible for another caller to reclaim.
+const idempotencyClaimMaxAge = 5 * time.Minute
+
+const insertIdempotencyClaimQuery = `
+INSERT INTO payment_idempotency(key, request_hash) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`
+
+const selectIdempotencyQuery = `
+SELECT request_hash, response FROM payment_idempotency WHERE key = $1`
+
+const updateIdempotencyResponseQuery = `
+UPDATE payment_idempotency SET response = $2::jsonb WHERE key = $1`
+
+const deleteFailedIdempotencyClaimQuery = `
+DELETE FROM payment_idempotency WHERE key = $1 AND response IS NULL`
+
+const reclaimStaleIdempotencyClaimQuery = `
+DELETE FROM payment_idempotency WHERE key = $1 AND response IS NULL AND created_at < $2`
+
+// idempotentResponse is the cached domain.Payment handle stored in
+// payment_idempotency.response so a replayed request can be answered
+// without re-applying the event.
+type idempotentResponse struct {
+	New bool   `json:"new"`
+	ID  string `json:"id"`
+}
+
+// persistIdempotent claims key for (customerID, event) and, on first use,
+// delegates to applyEvent and records its result; a replay of the same key
+// with the same request returns the recorded result instead of applying
+// the event again, and a replay with a different request is rejected.
+//
+// applyEvent is handed key so that reserve/complete/cancel/approve write
+// the cached response into payment_idempotency inside the very same
+// transaction that applies the event (see recordIdempotentResponse): a
+// committed event therefore always carries its response, and a row can
+// only be left with response IS NULL if the transaction never committed at
+// all. That's what makes the reclaim below safe — it can assume NULL means
+// "never applied", not "applied but not yet recorded".
+//
+// A claim whose response is still NULL past idempotencyClaimMaxAge is
+// treated as abandoned (its owner crashed, or its ctx was canceled, before
+// the transaction committed) and is reclaimed so the request isn't wedged
+// behind ErrIdempotencyInProgress forever.
+func persistIdempotent(ctx context.Context, key string, customerID uuid.UUID, event domain.Event) (domain.Payment, error) {
+	requestHash := hashRequest(customerID, event)
+
+	tag, err := pool.Exec(ctx, insertIdempotencyClaimQuery, key, requestHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag.RowsAffected() == 0 {
+		var existingHash string
+		var response []byte
+		err := pool.QueryRow(ctx, selectIdempotencyQuery, key).Scan(&existingHash, &response)
+		if err != nil {
+			return nil, err
+		}
+		if existingHash != requestHash {
+			return nil, domain.ErrIdempotencyConflict
+		}
+		if response == nil {
+			reclaimed, err := pool.Exec(ctx, reclaimStaleIdempotencyClaimQuery, key, time.Now().Add(-idempotencyClaimMaxAge))
+			if err != nil {
+				return nil, err
+			}
+			if reclaimed.RowsAffected() == 0 {
+				return nil, domain.ErrIdempotencyInProgress
+			}
+			return persistIdempotent(ctx, key, customerID, event)
+		}
+		return decodeIdempotentResponse(response)
+	}
+
+	payment, err := applyEvent(ctx, customerID, event, key)
+	if err != nil {
+		// The claim row this call just inserted never got a response, so
+		// leaving it behind would permanently wedge the key: every retry
+		// would see response == nil and get ErrIdempotencyInProgress
+		// instead of a real chance to retry. Release it (best effort) so
+		// the next attempt with the same key can re-claim and re-apply.
+		pool.Exec(ctx, deleteFailedIdempotencyClaimQuery, key)
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// recordIdempotentResponse writes payment's cached response for key inside
+// tx, so it commits atomically with the event tx applies. Call it as the
+// last step of a reserve/complete/cancel/approve transaction whenever key
+// is non-empty.
+func recordIdempotentResponse(ctx context.Context, tx pgx.Tx, key string, payment domain.Payment) error {
+	body, err := encodeIdempotentResponse(payment)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, updateIdempotencyResponseQuery, key, body)
+	return err
+}
+
+func hashRequest(customerID uuid.UUID, event domain.Event) string {
+	body, err := json.Marshal(struct {
+		CustomerID string       `json:"customer_id"`
+		Event      string       `json:"event"`
+		Payload    domain.Event `json:"payload"`
+	}{
+		CustomerID: customerID.String(),
+		Event:      fmt.Sprintf(`%T`, event),
+		Payload:    event,
+	})
+	if err != nil {
+		panic(fmt.Sprintf(`saga: marshal idempotency request: %v`, err))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeIdempotentResponse(payment domain.Payment) ([]byte, error) {
+	_, isNew := payment.(domain.NewPayment)
+	return json.Marshal(idempotentResponse{New: isNew, ID: payment.GetID().String()})
+}
+
+func decodeIdempotentResponse(body []byte) (domain.Payment, error) {
+	var resp idempotentResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	id, err := uuid.Parse(resp.ID)
+	if err != nil {
+		return nil, err
+	}
+	if resp.New {
+		return domain.NewPayment{ID: id}, nil
+	}
+	return domain.ExistingPayment{ID: id}, nil
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+
+	"github.com/moeryomenko/saga/internal/payment/domain"
+)
+
+const insertLedgerEntryQuery = `
+INSERT INTO ledger_entries(id, transaction_id, account, amount, payment_id) VALUES ($1, $2, $3, $4, $5)`
+
+const selectStatementQuery = `
+SELECT id, transaction_id, account, amount, payment_id, created_at
+FROM ledger_entries
+WHERE account = ANY($1) AND created_at >= $2 AND created_at < $3
+ORDER BY created_at`
+
+func accountAvailable(customerID uuid.UUID, currency string) string {
+	return fmt.Sprintf(`customer:%s:%s:available`, customerID, currency)
+}
+func accountReserved(customerID uuid.UUID, currency string) string {
+	return fmt.Sprintf(`customer:%s:%s:reserved`, customerID, currency)
+}
+func accountOrder(orderID uuid.UUID) string { return fmt.Sprintf(`system:orders:%s`, orderID) }
+
+// accountOpeningBalance is the counter-account for the opening postings
+// that back a customer's balance when their account is provisioned,
+// keeping every ledger transaction's postings summing to zero.
+func accountOpeningBalance() string { return `system:opening-balance` }
+
+// ledgerPosting is a single signed entry to append to ledger_entries.
+type ledgerPosting struct {
+	Account   string
+	Amount    decimal.Decimal
+	PaymentID uuid.UUID
+}
+
+// postLedger appends postings to ledger_entries under a shared
+// transactionID, inside the caller's transaction. Callers are responsible
+// for passing postings whose amounts sum to zero.
+func postLedger(ctx context.Context, tx pgx.Tx, transactionID uuid.UUID, postings []ledgerPosting) error {
+	for _, posting := range postings {
+		_, err := tx.Exec(ctx, insertLedgerEntryQuery, uuid.New(), transactionID, posting.Account, posting.Amount, posting.PaymentID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Statement returns the double-entry postings against customerID's
+// available and reserved accounts in currency, in [from, to), ordered
+// oldest first.
+func Statement(ctx context.Context, customerID uuid.UUID, currency string, from, to time.Time) ([]domain.Posting, error) {
+	accounts := []string{accountAvailable(customerID, currency), accountReserved(customerID, currency)}
+
+	rows, err := pool.Query(ctx, selectStatementQuery, accounts, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var postings []domain.Posting
+	for rows.Next() {
+		var posting domain.Posting
+		if err := rows.Scan(&posting.ID, &posting.TransactionID, &posting.Account, &posting.Amount, &posting.PaymentID, &posting.CreatedAt); err != nil {
+			return nil, err
+		}
+		postings = append(postings, posting)
+	}
+	return postings, rows.Err()
+}
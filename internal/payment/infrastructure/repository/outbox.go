@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+)
+
+const selectLastEventHashQuery = `
+SELECT hash FROM payment_events WHERE payment_id = $1 ORDER BY created_at DESC LIMIT 1`
+
+const insertPaymentEventQuery = `
+INSERT INTO payment_events(id, payment_id, customer_id, status, hash, payload) VALUES ($1, $2, $3, $4, $5, $6::jsonb)`
+
+// outboxPayload is the change-detected snapshot written to payment_events;
+// it carries the payment's status and the customer's available/reserved
+// balance as they stand after the event that triggered it.
+type outboxPayload struct {
+	PaymentID string `json:"payment_id"`
+	Status    string `json:"status"`
+	Available string `json:"available_amount"`
+	Reserved  string `json:"reserved_amount"`
+}
+
+// writeOutboxEvent appends a payment_events row inside the same transaction
+// as the balance/payment mutation it follows, but only when the resulting
+// state actually differs from the last event recorded for this payment.
+// Skipping unchanged writes keeps downstream outbox consumers from seeing a
+// duplicate event for a PersistTransaction call that didn't carry an
+// idempotency key (idempotency.go only dedupes when the caller opts in via
+// domain.WithIdempotencyKey; this is the backstop for callers that don't).
+func writeOutboxEvent(ctx context.Context, tx pgx.Tx, paymentID, customerID uuid.UUID, status string, available, reserved decimal.Decimal) error {
+	payload := outboxPayload{
+		PaymentID: paymentID.String(),
+		Status:    status,
+		Available: available.String(),
+		Reserved:  reserved.String(),
+	}
+
+	hash, err := hashPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	var lastHash string
+	err = tx.QueryRow(ctx, selectLastEventHashQuery, paymentID).Scan(&lastHash)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	if hash == lastHash {
+		return nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, insertPaymentEventQuery, uuid.New(), paymentID, customerID, status, hash, body)
+	return err
+}
+
+func hashPayload(payload outboxPayload) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return ``, fmt.Errorf(`saga: marshal outbox payload: %w`, err)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
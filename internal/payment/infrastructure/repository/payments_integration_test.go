@@ -2,8 +2,11 @@ package repository
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
@@ -38,7 +41,12 @@ func positivePayments(ctx context.Context, t *testing.T) {
 		orderID                uuid.UUID
 		customer               func() (uuid.UUID, error)
 		amount                 decimal.Decimal
+		currency               string
+		settlementCurrency     string
+		fxProvider             domain.FXProvider
+		approvalPolicy         *approvalPolicySetup
 		finalEvent             func(uuid.UUID) domain.Event
+		expectedReserveStatus  string
 		expectedCreatedBalance domain.Balance
 		expectedFinalBalance   domain.Balance
 	}{
@@ -47,10 +55,7 @@ func positivePayments(ctx context.Context, t *testing.T) {
 			customer: func() (uuid.UUID, error) {
 				customerID := uuid.New()
 				available := decimal.NewFromInt32(100)
-				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
-					_, err := tx.Exec(ctx, `INSERT INTO balances(customer_id, available_amount) VALUES ($1, $2)`, customerID, available)
-					return err
-				})
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
 				return customerID, err
 			},
 			amount: decimal.NewFromInt32(20),
@@ -71,10 +76,7 @@ func positivePayments(ctx context.Context, t *testing.T) {
 			customer: func() (uuid.UUID, error) {
 				customerID := uuid.New()
 				available := decimal.NewFromInt32(100)
-				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
-					_, err := tx.Exec(ctx, `INSERT INTO balances(customer_id, available_amount) VALUES ($1, $2)`, customerID, available)
-					return err
-				})
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
 				return customerID, err
 			},
 			amount: decimal.NewFromInt32(20),
@@ -90,29 +92,120 @@ func positivePayments(ctx context.Context, t *testing.T) {
 				Reserved: decimal.Zero,
 			},
 		},
+		`cross-currency reserve converts at the locked rate`: {
+			orderID: uuid.New(),
+			customer: func() (uuid.UUID, error) {
+				customerID := uuid.New()
+				available := decimal.NewFromInt32(100)
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
+				return customerID, err
+			},
+			amount:             decimal.NewFromInt32(20),
+			currency:           `EUR`,
+			settlementCurrency: `USD`,
+			fxProvider:         fakeFXProvider{rate: decimal.NewFromFloat(1.1), asOf: time.Now()},
+			finalEvent: func(u uuid.UUID) domain.Event {
+				return domain.Complete{PaymentID: u}
+			},
+			expectedCreatedBalance: domain.Balance{
+				Amount:   decimal.NewFromInt32(100).Sub(decimal.NewFromInt32(20).Mul(decimal.NewFromFloat(1.1))),
+				Reserved: decimal.NewFromInt32(20).Mul(decimal.NewFromFloat(1.1)),
+			},
+			expectedFinalBalance: domain.Balance{
+				Amount:   decimal.NewFromInt32(100).Sub(decimal.NewFromInt32(20).Mul(decimal.NewFromFloat(1.1))),
+				Reserved: decimal.Zero,
+			},
+		},
+		`2-of-3 approvers`: {
+			orderID: uuid.New(),
+			customer: func() (uuid.UUID, error) {
+				customerID := uuid.New()
+				available := decimal.NewFromInt32(100)
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
+				return customerID, err
+			},
+			amount: decimal.NewFromInt32(20),
+			approvalPolicy: &approvalPolicySetup{
+				threshold:         decimal.NewFromInt32(10),
+				requiredApprovals: 2,
+				approvers:         []testApprover{newTestApprover(t), newTestApprover(t), newTestApprover(t)},
+				signers:           2,
+			},
+			finalEvent: func(u uuid.UUID) domain.Event {
+				return domain.Complete{PaymentID: u}
+			},
+			expectedReserveStatus: statusPendingApproval,
+			expectedCreatedBalance: domain.Balance{
+				Amount:   decimal.NewFromInt32(80),
+				Reserved: decimal.NewFromInt32(20),
+			},
+			expectedFinalBalance: domain.Balance{
+				Amount:   decimal.NewFromInt32(80),
+				Reserved: decimal.Zero,
+			},
+		},
 	}
 
 	for name, tc := range testcases {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
+			settlementCurrency := tc.settlementCurrency
+			if settlementCurrency == `` {
+				settlementCurrency = `USD`
+			}
+			reserveStatus := tc.expectedReserveStatus
+			if reserveStatus == `` {
+				reserveStatus = statusReserved
+			}
+
 			customerID, err := tc.customer()
 			require.NoError(t, err)
 			tc.expectedCreatedBalance.CustomerID = customerID
 			tc.expectedFinalBalance.CustomerID = customerID
 
-			// create payments.
-			payment, err := PersistTransaction(ctx, customerID, domain.Reserve{OrderID: tc.orderID, Amount: tc.amount})
+			if tc.fxProvider != nil {
+				SetFXProvider(tc.fxProvider)
+				defer SetFXProvider(nil)
+			}
+
+			if tc.approvalPolicy != nil {
+				require.NoError(t, tc.approvalPolicy.install(ctx, customerID))
+			}
+
+			// create payments, via an idempotency key so we can assert below
+			// that replaying the same Reserve does not move the balance twice.
+			reserveEvent := domain.Reserve{OrderID: tc.orderID, Amount: tc.amount, Currency: tc.currency, SettlementCurrency: tc.settlementCurrency}
+			idemCtx := domain.WithIdempotencyKey(ctx, `reserve-`+tc.orderID.String())
+
+			payment, err := PersistTransaction(idemCtx, customerID, reserveEvent)
 			require.NoError(t, err)
-			checkBalance(ctx, t, customerID, tc.expectedCreatedBalance)
+			checkBalance(ctx, t, customerID, settlementCurrency, tc.expectedCreatedBalance)
 			if _, ok := payment.(domain.NewPayment); !ok {
 				require.Fail(t, `expected payment created`)
 			}
+			checkOutboxEvent(ctx, t, payment.GetID(), reserveStatus)
+
+			replay, err := PersistTransaction(idemCtx, customerID, reserveEvent)
+			require.NoError(t, err)
+			require.Equal(t, payment.GetID(), replay.GetID())
+			checkBalance(ctx, t, customerID, settlementCurrency, tc.expectedCreatedBalance)
+
+			if tc.approvalPolicy != nil {
+				for _, approver := range tc.approvalPolicy.approvers[:tc.approvalPolicy.signers] {
+					approval := domain.Approve{PaymentID: payment.GetID(), ApproverID: approver.id, Signature: approver.sign(payment.GetID())}
+					_, err := PersistTransaction(ctx, customerID, approval)
+					require.NoError(t, err)
+				}
+			}
 
 			// complete payments.
 			event := tc.finalEvent(payment.GetID())
 			_, err = PersistTransaction(ctx, customerID, event)
 			require.NoError(t, err)
-			checkBalance(ctx, t, customerID, tc.expectedFinalBalance)
+			checkBalance(ctx, t, customerID, settlementCurrency, tc.expectedFinalBalance)
+			checkOutboxEvent(ctx, t, payment.GetID(), finalStatus(event))
+			checkOutboxEventCount(ctx, t, payment.GetID(), 2)
+			checkLedgerBalanced(ctx, t, payment.GetID(), 2)
 		})
 	}
 }
@@ -123,6 +216,8 @@ func negativePayments(ctx context.Context, t *testing.T) {
 		customer        func() (uuid.UUID, error)
 		preparePayment  func(uuid.UUID, uuid.UUID) (uuid.UUID, error)
 		event           func(uuid.UUID, uuid.UUID) domain.Event
+		fxProvider      domain.FXProvider
+		autoExpire      bool
 		expectedError   error
 		expectedBalance domain.Balance
 	}{
@@ -131,10 +226,7 @@ func negativePayments(ctx context.Context, t *testing.T) {
 			customer: func() (uuid.UUID, error) {
 				customerID := uuid.New()
 				available := decimal.NewFromInt32(40)
-				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
-					_, err := tx.Exec(ctx, `INSERT INTO balances(customer_id, available_amount) VALUES ($1, $2)`, customerID, available)
-					return err
-				})
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
 				return customerID, err
 			},
 			event: func(orderID, _ uuid.UUID) domain.Event {
@@ -151,16 +243,13 @@ func negativePayments(ctx context.Context, t *testing.T) {
 			customer: func() (uuid.UUID, error) {
 				customerID := uuid.New()
 				available := decimal.NewFromInt32(40)
-				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
-					_, err := tx.Exec(ctx, `INSERT INTO balances(customer_id, available_amount) VALUES ($1, $2)`, customerID, available)
-					return err
-				})
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
 				return customerID, err
 			},
 			preparePayment: func(customerID, orderID uuid.UUID) (uuid.UUID, error) {
 				paymentID := uuid.New()
 				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
-					_, err := tx.Exec(ctx, insertPaymentQuery, paymentID, statusCompleted, customerID, orderID, decimal.NewFromInt32(20))
+					_, err := tx.Exec(ctx, insertPaymentQuery, paymentID, statusCompleted, customerID, orderID, decimal.NewFromInt32(20), nil, `USD`, `USD`, decimal.NewFromInt32(20), 0)
 					return err
 				})
 				return paymentID, err
@@ -179,16 +268,81 @@ func negativePayments(ctx context.Context, t *testing.T) {
 			customer: func() (uuid.UUID, error) {
 				customerID := uuid.New()
 				available := decimal.NewFromInt32(40)
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
+				return customerID, err
+			},
+			preparePayment: func(customerID, orderID uuid.UUID) (uuid.UUID, error) {
+				paymentID := uuid.New()
 				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
-					_, err := tx.Exec(ctx, `INSERT INTO balances(customer_id, available_amount) VALUES ($1, $2)`, customerID, available)
+					_, err := tx.Exec(ctx, insertPaymentQuery, paymentID, statusCanceled, customerID, orderID, decimal.NewFromInt32(20), nil, `USD`, `USD`, decimal.NewFromInt32(20), 0)
 					return err
 				})
+				return paymentID, err
+			},
+			event: func(_, paymentID uuid.UUID) domain.Event {
+				return domain.Complete{PaymentID: paymentID}
+			},
+			expectedBalance: domain.Balance{
+				Amount:   decimal.NewFromInt32(40),
+				Reserved: decimal.Zero,
+			},
+			expectedError: domain.ErrCanceledPayment,
+		},
+		`expired reservation auto-cancels`: {
+			orderID: uuid.New(),
+			customer: func() (uuid.UUID, error) {
+				customerID := uuid.New()
+				available := decimal.NewFromInt32(40)
+				reserved := decimal.NewFromInt32(20)
+				err := OpenBalance(ctx, customerID, `USD`, available, reserved)
 				return customerID, err
 			},
 			preparePayment: func(customerID, orderID uuid.UUID) (uuid.UUID, error) {
 				paymentID := uuid.New()
+				expiresAt := time.Now().Add(-time.Hour)
 				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
-					_, err := tx.Exec(ctx, insertPaymentQuery, paymentID, statusCanceled, customerID, orderID, decimal.NewFromInt32(20))
+					_, err := tx.Exec(ctx, insertPaymentQuery, paymentID, statusReserved, customerID, orderID, decimal.NewFromInt32(20), expiresAt, `USD`, `USD`, decimal.NewFromInt32(20), 0)
+					return err
+				})
+				return paymentID, err
+			},
+			autoExpire: true,
+			expectedBalance: domain.Balance{
+				Amount:   decimal.NewFromInt32(60),
+				Reserved: decimal.Zero,
+			},
+		},
+		`stale fx rate rejected`: {
+			orderID: uuid.New(),
+			customer: func() (uuid.UUID, error) {
+				customerID := uuid.New()
+				available := decimal.NewFromInt32(100)
+				err := OpenBalance(ctx, customerID, `USD`, available, decimal.Zero)
+				return customerID, err
+			},
+			fxProvider: fakeFXProvider{rate: decimal.NewFromFloat(1.1), asOf: time.Now().Add(-time.Hour)},
+			event: func(orderID, _ uuid.UUID) domain.Event {
+				return domain.Reserve{OrderID: orderID, Amount: decimal.NewFromInt32(20), Currency: `EUR`, SettlementCurrency: `USD`}
+			},
+			expectedBalance: domain.Balance{
+				Amount:   decimal.NewFromInt32(100),
+				Reserved: decimal.Zero,
+			},
+			expectedError: domain.ErrRateStale,
+		},
+		`unsigned complete`: {
+			orderID: uuid.New(),
+			customer: func() (uuid.UUID, error) {
+				customerID := uuid.New()
+				available := decimal.NewFromInt32(40)
+				reserved := decimal.NewFromInt32(20)
+				err := OpenBalance(ctx, customerID, `USD`, available, reserved)
+				return customerID, err
+			},
+			preparePayment: func(customerID, orderID uuid.UUID) (uuid.UUID, error) {
+				paymentID := uuid.New()
+				err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+					_, err := tx.Exec(ctx, insertPaymentQuery, paymentID, statusPendingApproval, customerID, orderID, decimal.NewFromInt32(20), nil, `USD`, `USD`, decimal.NewFromInt32(20), 2)
 					return err
 				})
 				return paymentID, err
@@ -198,9 +352,9 @@ func negativePayments(ctx context.Context, t *testing.T) {
 			},
 			expectedBalance: domain.Balance{
 				Amount:   decimal.NewFromInt32(40),
-				Reserved: decimal.Zero,
+				Reserved: decimal.NewFromInt32(20),
 			},
-			expectedError: domain.ErrCanceledPayment,
+			expectedError: domain.ErrInsufficientApprovals,
 		},
 	}
 
@@ -218,19 +372,136 @@ func negativePayments(ctx context.Context, t *testing.T) {
 			}()
 			require.NoError(t, err)
 
+			if tc.fxProvider != nil {
+				SetFXProvider(tc.fxProvider)
+				defer SetFXProvider(nil)
+			}
+
+			if tc.autoExpire {
+				expired, err := ExpireReservations(ctx, 10)
+				require.NoError(t, err)
+				require.Equal(t, 1, expired)
+				checkBalance(ctx, t, customerID, `USD`, tc.expectedBalance)
+				return
+			}
+
 			_, err = PersistTransaction(ctx, customerID, tc.event(tc.orderID, paymentID))
 			require.ErrorIs(t, err, tc.expectedError)
-			checkBalance(ctx, t, customerID, tc.expectedBalance)
+			checkBalance(ctx, t, customerID, `USD`, tc.expectedBalance)
 		})
 	}
 }
 
-func checkBalance(ctx context.Context, t *testing.T, customerID uuid.UUID, expectedBalance domain.Balance) {
+func checkBalance(ctx context.Context, t *testing.T, customerID uuid.UUID, currency string, expectedBalance domain.Balance) {
 	var balance domain.Balance
 	pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) (err error) {
-		balance, err = findBalanceByCustomer(ctx, tx, customerID)
+		balance, err = findBalanceByCustomer(ctx, tx, customerID, currency)
 		return
 	})
 	require.Equal(t, expectedBalance.Amount.String(), balance.Amount.String())
 	require.Equal(t, expectedBalance.Reserved.String(), balance.Reserved.String())
 }
+
+// fakeFXProvider is a test double for domain.FXProvider returning a fixed
+// rate stamped with a caller-supplied AsOf, so tests can exercise both a
+// fresh and a stale quote.
+type fakeFXProvider struct {
+	rate decimal.Decimal
+	asOf time.Time
+}
+
+func (p fakeFXProvider) Rate(_ context.Context, _, _ string) (domain.FXQuote, error) {
+	return domain.FXQuote{Rate: p.rate, AsOf: p.asOf}, nil
+}
+
+// testApprover is a registered multi-signature approver with a keypair the
+// test can sign approvals with.
+type testApprover struct {
+	id         uuid.UUID
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func newTestApprover(t *testing.T) testApprover {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return testApprover{id: uuid.New(), publicKey: publicKey, privateKey: privateKey}
+}
+
+func (a testApprover) sign(paymentID uuid.UUID) []byte {
+	return ed25519.Sign(a.privateKey, []byte(paymentID.String()))
+}
+
+// approvalPolicySetup registers an approval policy and its approvers for a
+// customer, and picks how many of those approvers actually sign.
+type approvalPolicySetup struct {
+	threshold         decimal.Decimal
+	requiredApprovals int
+	approvers         []testApprover
+	signers           int
+}
+
+func (s approvalPolicySetup) install(ctx context.Context, customerID uuid.UUID) error {
+	return pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO customer_approval_policies(customer_id, threshold, required_approvals) VALUES ($1, $2, $3)`, customerID, s.threshold, s.requiredApprovals)
+		if err != nil {
+			return err
+		}
+		for _, approver := range s.approvers {
+			_, err := tx.Exec(ctx, `INSERT INTO customer_approvers(customer_id, approver_id, public_key) VALUES ($1, $2, $3)`, customerID, approver.id, []byte(approver.publicKey))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkOutboxEvent asserts that the most recent payment_events row for
+// paymentID records expectedStatus.
+func checkOutboxEvent(ctx context.Context, t *testing.T, paymentID uuid.UUID, expectedStatus string) {
+	var status string
+	err := pool.QueryRow(ctx, `SELECT status FROM payment_events WHERE payment_id = $1 ORDER BY created_at DESC LIMIT 1`, paymentID).Scan(&status)
+	require.NoError(t, err)
+	require.Equal(t, expectedStatus, status)
+}
+
+// checkOutboxEventCount asserts how many payment_events rows were written
+// for paymentID, catching duplicate writes that the change-detection hash
+// should have skipped.
+func checkOutboxEventCount(ctx context.Context, t *testing.T, paymentID uuid.UUID, expected int) {
+	var count int
+	err := pool.QueryRow(ctx, `SELECT count(*) FROM payment_events WHERE payment_id = $1`, paymentID).Scan(&count)
+	require.NoError(t, err)
+	require.Equal(t, expected, count)
+}
+
+// checkLedgerBalanced asserts that paymentID produced expectedTransactions
+// ledger_entries transactions, each debiting and crediting equal amounts.
+func checkLedgerBalanced(ctx context.Context, t *testing.T, paymentID uuid.UUID, expectedTransactions int) {
+	rows, err := pool.Query(ctx, `SELECT transaction_id, SUM(amount) FROM ledger_entries WHERE payment_id = $1 GROUP BY transaction_id`, paymentID)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var transactionID uuid.UUID
+		var sum decimal.Decimal
+		require.NoError(t, rows.Scan(&transactionID, &sum))
+		require.True(t, sum.IsZero(), `unbalanced ledger transaction %s: debits/credits sum to %s`, transactionID, sum)
+		count++
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, expectedTransactions, count)
+}
+
+func finalStatus(event domain.Event) string {
+	switch event.(type) {
+	case domain.Complete:
+		return statusCompleted
+	case domain.Cancel:
+		return statusCanceled
+	default:
+		return ``
+	}
+}
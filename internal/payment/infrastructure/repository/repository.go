@@ -0,0 +1,361 @@
+// Package repository is the pgx-backed persistence layer for the payment
+// saga: it applies domain events against the `balances` and `payments`
+// tables inside a single transaction per event, recording each mutation
+// as double-entry postings in `ledger_entries` (see ledger.go), from which
+// balances are read and against which the `balances` row is reconciled.
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/shopspring/decimal"
+
+	"github.com/moeryomenko/saga/internal/payment/domain"
+)
+
+var pool *pgxpool.Pool
+
+const (
+	statusReserved        = `reserved`
+	statusPendingApproval = `pending_approval`
+	statusCompleted       = `completed`
+	statusCanceled        = `canceled`
+	statusOpeningBalance  = `opening_balance`
+)
+
+const insertOpeningBalanceQuery = `
+INSERT INTO balances(customer_id, currency, available_amount, reserved_amount) VALUES ($1, $2, $3, $4)`
+
+const insertPaymentQuery = `
+INSERT INTO payments(id, status, customer_id, order_id, amount, expires_at, currency, settlement_currency, settled_amount, required_approvals)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+const selectPaymentForUpdateQuery = `
+SELECT status, customer_id, order_id, settlement_currency, settled_amount, required_approvals FROM payments WHERE id = $1 FOR UPDATE`
+
+const selectBalanceForUpdateQuery = `
+SELECT available_amount, reserved_amount FROM balances WHERE customer_id = $1 AND currency = $2 FOR UPDATE`
+
+const selectLedgerBalanceQuery = `
+SELECT
+	COALESCE(SUM(amount) FILTER (WHERE account = $1), 0),
+	COALESCE(SUM(amount) FILTER (WHERE account = $2), 0)
+FROM ledger_entries
+WHERE account IN ($1, $2)`
+
+// PersistTransaction applies event to customerID's balance and payments,
+// atomically, and returns a handle to the affected payment. If ctx carries
+// an idempotency key (see domain.WithIdempotencyKey), a replay of the same
+// key and event returns the cached result instead of applying it again.
+func PersistTransaction(ctx context.Context, customerID uuid.UUID, event domain.Event) (domain.Payment, error) {
+	if key, ok := domain.IdempotencyKeyFromContext(ctx); ok {
+		return persistIdempotent(ctx, key, customerID, event)
+	}
+	return applyEvent(ctx, customerID, event, ``)
+}
+
+// applyEvent dispatches event to its handler. idemKey is the idempotency
+// key to record a cached response under (see recordIdempotentResponse), or
+// "" when the caller didn't supply one (no dedupe is attempted in that
+// case).
+func applyEvent(ctx context.Context, customerID uuid.UUID, event domain.Event, idemKey string) (domain.Payment, error) {
+	switch e := event.(type) {
+	case domain.Reserve:
+		return reserve(ctx, customerID, e, idemKey)
+	case domain.Complete:
+		return complete(ctx, customerID, e, idemKey)
+	case domain.Cancel:
+		return cancel(ctx, pool, customerID, e, idemKey)
+	case domain.Approve:
+		return approve(ctx, customerID, e, idemKey)
+	default:
+		return nil, domain.ErrUnknownEvent
+	}
+}
+
+func reserve(ctx context.Context, customerID uuid.UUID, event domain.Reserve, idemKey string) (domain.Payment, error) {
+	paymentID := uuid.New()
+
+	var expiresAt *time.Time
+	if event.TTL > 0 {
+		t := time.Now().Add(event.TTL)
+		expiresAt = &t
+	}
+
+	currency := event.Currency
+	if currency == `` {
+		currency = `USD`
+	}
+	settlementCurrency := event.SettlementCurrency
+	if settlementCurrency == `` {
+		settlementCurrency = currency
+	}
+
+	settledAmount := event.Amount
+	if settlementCurrency != currency {
+		if fxProvider == nil {
+			return nil, domain.ErrFXProviderRequired
+		}
+
+		quote, err := fxProvider.Rate(ctx, currency, settlementCurrency)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(quote.AsOf) > rateFreshnessWindow {
+			return nil, domain.ErrRateStale
+		}
+
+		settledAmount = event.Amount.Mul(quote.Rate)
+	}
+
+	err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+		balance, err := findBalanceByCustomer(ctx, tx, customerID, settlementCurrency)
+		if err != nil {
+			return err
+		}
+
+		if balance.Amount.LessThan(settledAmount) {
+			return domain.ErrInsufficientFunds
+		}
+
+		status := statusReserved
+		requiredApprovals := 0
+		policy, ok, err := approvalPolicyFor(ctx, tx, customerID)
+		if err != nil {
+			return err
+		}
+		if ok && settledAmount.GreaterThan(policy.Threshold) {
+			status = statusPendingApproval
+			requiredApprovals = policy.RequiredApprovals
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE balances SET available_amount = available_amount - $1, reserved_amount = reserved_amount + $1 WHERE customer_id = $2 AND currency = $3`, settledAmount, customerID, settlementCurrency)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, insertPaymentQuery, paymentID, status, customerID, event.OrderID, event.Amount, expiresAt, currency, settlementCurrency, settledAmount, requiredApprovals)
+		if err != nil {
+			return err
+		}
+
+		err = postLedger(ctx, tx, uuid.New(), []ledgerPosting{
+			{Account: accountAvailable(customerID, settlementCurrency), Amount: settledAmount.Neg(), PaymentID: paymentID},
+			{Account: accountReserved(customerID, settlementCurrency), Amount: settledAmount, PaymentID: paymentID},
+		})
+		if err != nil {
+			return err
+		}
+
+		if idemKey != `` {
+			if err := recordIdempotentResponse(ctx, tx, idemKey, domain.NewPayment{ID: paymentID}); err != nil {
+				return err
+			}
+		}
+
+		return writeOutboxEvent(ctx, tx, paymentID, customerID, status, balance.Amount.Sub(settledAmount), balance.Reserved.Add(settledAmount))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return domain.NewPayment{ID: paymentID}, nil
+}
+
+func complete(ctx context.Context, customerID uuid.UUID, event domain.Complete, idemKey string) (domain.Payment, error) {
+	err := pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+		payment, err := findPaymentForUpdate(ctx, tx, event.PaymentID)
+		if err != nil {
+			return err
+		}
+
+		switch payment.Status {
+		case statusCanceled:
+			return domain.ErrCanceledPayment
+		case statusCompleted:
+			return domain.ErrCompletedPayment
+		case statusPendingApproval:
+			approved, err := hasSufficientApprovals(ctx, tx, event.PaymentID, payment.RequiredApprovals)
+			if err != nil {
+				return err
+			}
+			if !approved {
+				return domain.ErrInsufficientApprovals
+			}
+		}
+
+		balance, err := findBalanceByCustomer(ctx, tx, customerID, payment.SettlementCurrency)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE balances SET reserved_amount = reserved_amount - $1 WHERE customer_id = $2 AND currency = $3`, payment.SettledAmount, customerID, payment.SettlementCurrency)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE payments SET status = $1 WHERE id = $2`, statusCompleted, event.PaymentID)
+		if err != nil {
+			return err
+		}
+
+		err = postLedger(ctx, tx, uuid.New(), []ledgerPosting{
+			{Account: accountReserved(customerID, payment.SettlementCurrency), Amount: payment.SettledAmount.Neg(), PaymentID: event.PaymentID},
+			{Account: accountOrder(payment.OrderID), Amount: payment.SettledAmount, PaymentID: event.PaymentID},
+		})
+		if err != nil {
+			return err
+		}
+
+		if idemKey != `` {
+			if err := recordIdempotentResponse(ctx, tx, idemKey, domain.ExistingPayment{ID: event.PaymentID}); err != nil {
+				return err
+			}
+		}
+
+		return writeOutboxEvent(ctx, tx, event.PaymentID, customerID, statusCompleted, balance.Amount, balance.Reserved.Sub(payment.SettledAmount))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return domain.ExistingPayment{ID: event.PaymentID}, nil
+}
+
+// txBeginner is satisfied by both *pgxpool.Pool and *pgxpool.Conn. cancel
+// takes it rather than closing over the package-level pool so callers that
+// already hold a connection (e.g. expireOne, which cancels under an
+// advisory lock held on a single connection) can run the transaction on
+// that same connection instead of acquiring a second one from the pool.
+type txBeginner interface {
+	BeginTxFunc(ctx context.Context, txOptions pgx.TxOptions, f func(pgx.Tx) error) error
+}
+
+func cancel(ctx context.Context, db txBeginner, customerID uuid.UUID, event domain.Cancel, idemKey string) (domain.Payment, error) {
+	err := db.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+		payment, err := findPaymentForUpdate(ctx, tx, event.PaymentID)
+		if err != nil {
+			return err
+		}
+
+		switch payment.Status {
+		case statusCompleted:
+			return domain.ErrCompletedPayment
+		case statusCanceled:
+			return domain.ErrCanceledPayment
+		}
+
+		balance, err := findBalanceByCustomer(ctx, tx, customerID, payment.SettlementCurrency)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE balances SET available_amount = available_amount + $1, reserved_amount = reserved_amount - $1 WHERE customer_id = $2 AND currency = $3`, payment.SettledAmount, customerID, payment.SettlementCurrency)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE payments SET status = $1 WHERE id = $2`, statusCanceled, event.PaymentID)
+		if err != nil {
+			return err
+		}
+
+		err = postLedger(ctx, tx, uuid.New(), []ledgerPosting{
+			{Account: accountReserved(customerID, payment.SettlementCurrency), Amount: payment.SettledAmount.Neg(), PaymentID: event.PaymentID},
+			{Account: accountAvailable(customerID, payment.SettlementCurrency), Amount: payment.SettledAmount, PaymentID: event.PaymentID},
+		})
+		if err != nil {
+			return err
+		}
+
+		if idemKey != `` {
+			if err := recordIdempotentResponse(ctx, tx, idemKey, domain.ExistingPayment{ID: event.PaymentID}); err != nil {
+				return err
+			}
+		}
+
+		return writeOutboxEvent(ctx, tx, event.PaymentID, customerID, statusCanceled, balance.Amount.Add(payment.SettledAmount), balance.Reserved.Sub(payment.SettledAmount))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return domain.ExistingPayment{ID: event.PaymentID}, nil
+}
+
+// paymentForUpdate is a snapshot of a payments row locked FOR UPDATE by
+// findPaymentForUpdate, used by complete/cancel to decide how to mutate
+// the customer's balance and ledger.
+type paymentForUpdate struct {
+	Status             string
+	CustomerID         uuid.UUID
+	OrderID            uuid.UUID
+	SettlementCurrency string
+	SettledAmount      decimal.Decimal
+	RequiredApprovals  int
+}
+
+func findPaymentForUpdate(ctx context.Context, tx pgx.Tx, paymentID uuid.UUID) (paymentForUpdate, error) {
+	var payment paymentForUpdate
+	err := tx.QueryRow(ctx, selectPaymentForUpdateQuery, paymentID).Scan(&payment.Status, &payment.CustomerID, &payment.OrderID, &payment.SettlementCurrency, &payment.SettledAmount, &payment.RequiredApprovals)
+	if err == pgx.ErrNoRows {
+		err = domain.ErrPaymentNotFound
+	}
+	return payment, err
+}
+
+// findBalanceByCustomer locks customerID's balances row for the duration of
+// the caller's transaction (serializing concurrent mutations against it),
+// then derives the actual available/reserved amounts from the SUM of
+// customerID's ledger_entries postings, since the ledger — not the mutable
+// balances row — is the auditable source of truth. If the two have
+// drifted, it returns domain.ErrLedgerBalanceMismatch rather than a
+// balance that can't be trusted.
+func findBalanceByCustomer(ctx context.Context, tx pgx.Tx, customerID uuid.UUID, currency string) (domain.Balance, error) {
+	balance := domain.Balance{CustomerID: customerID, Currency: currency}
+
+	var shadow domain.Balance
+	if err := tx.QueryRow(ctx, selectBalanceForUpdateQuery, customerID, currency).Scan(&shadow.Amount, &shadow.Reserved); err != nil {
+		return balance, err
+	}
+
+	err := tx.QueryRow(ctx, selectLedgerBalanceQuery, accountAvailable(customerID, currency), accountReserved(customerID, currency)).Scan(&balance.Amount, &balance.Reserved)
+	if err != nil {
+		return balance, err
+	}
+	if !balance.Amount.Equal(shadow.Amount) || !balance.Reserved.Equal(shadow.Reserved) {
+		return balance, domain.ErrLedgerBalanceMismatch
+	}
+
+	return balance, nil
+}
+
+// OpenBalance provisions customerID's balance in currency with the given
+// opening available/reserved amounts. It posts the matching ledger_entries
+// postings in the same transaction (against the accountOpeningBalance
+// counter-account) so findBalanceByCustomer has something to reconcile
+// against from the very first read, rather than treating a freshly
+// provisioned balance as a ledger mismatch.
+func OpenBalance(ctx context.Context, customerID uuid.UUID, currency string, available, reserved decimal.Decimal) error {
+	return pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+		openingID := uuid.New()
+		_, err := tx.Exec(ctx, insertPaymentQuery, openingID, statusOpeningBalance, customerID, uuid.New(), decimal.Zero, nil, currency, currency, decimal.Zero, 0)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, insertOpeningBalanceQuery, customerID, currency, available, reserved); err != nil {
+			return err
+		}
+
+		return postLedger(ctx, tx, uuid.New(), []ledgerPosting{
+			{Account: accountAvailable(customerID, currency), Amount: available, PaymentID: openingID},
+			{Account: accountReserved(customerID, currency), Amount: reserved, PaymentID: openingID},
+			{Account: accountOpeningBalance(), Amount: available.Add(reserved).Neg(), PaymentID: openingID},
+		})
+	})
+}
@@ -0,0 +1,29 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+// LogPublisher publishes outbox messages to a zerolog logger. It is meant
+// for local development and as a Publisher of last resort; Kafka/NATS
+// publishers should implement the same interface.
+type LogPublisher struct {
+	log zerolog.Logger
+}
+
+// NewLogPublisher builds a LogPublisher that writes to log.
+func NewLogPublisher(log zerolog.Logger) *LogPublisher {
+	return &LogPublisher{log: log}
+}
+
+func (p *LogPublisher) Publish(_ context.Context, msg Message) error {
+	p.log.Info().
+		Str(`payment_id`, msg.PaymentID.String()).
+		Str(`customer_id`, msg.CustomerID.String()).
+		Str(`status`, msg.Status).
+		RawJSON(`payload`, msg.Payload).
+		Msg(`outbox: dispatched event`)
+	return nil
+}
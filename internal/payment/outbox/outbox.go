@@ -0,0 +1,155 @@
+// Package outbox dispatches rows written to the payment_events outbox
+// table by the repository package to an external bus, using
+// FOR UPDATE SKIP LOCKED so multiple replicas can poll the same table
+// without contending on the same rows.
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+// Message is a single payment_events row handed to a Publisher.
+type Message struct {
+	ID         uuid.UUID
+	PaymentID  uuid.UUID
+	CustomerID uuid.UUID
+	Status     string
+	Payload    []byte
+}
+
+// Publisher delivers a Message to an external system (Kafka, NATS, a log
+// sink, ...). A Publisher is expected to be idempotent on retry, since a
+// Message may be redelivered after a crash between Publish and markSent.
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+const selectUnsentQuery = `
+SELECT id, payment_id, customer_id, status, payload
+FROM payment_events
+WHERE sent_at IS NULL
+ORDER BY created_at
+LIMIT $1
+FOR UPDATE SKIP LOCKED`
+
+const markSentQuery = `UPDATE payment_events SET sent_at = now() WHERE id = $1`
+
+// Dispatcher polls payment_events and publishes unsent rows.
+type Dispatcher struct {
+	pool      *pgxpool.Pool
+	publisher Publisher
+	log       zerolog.Logger
+
+	batchSize    int
+	pollInterval time.Duration
+	maxBackoff   time.Duration
+}
+
+// Option configures a Dispatcher.
+type Option func(*Dispatcher)
+
+// WithBatchSize sets how many rows are claimed per poll. Defaults to 20.
+func WithBatchSize(n int) Option {
+	return func(d *Dispatcher) { d.batchSize = n }
+}
+
+// WithPollInterval sets the steady-state delay between polls. Defaults to
+// one second.
+func WithPollInterval(interval time.Duration) Option {
+	return func(d *Dispatcher) { d.pollInterval = interval }
+}
+
+// WithMaxBackoff caps the exponential backoff applied after a failed poll.
+// Defaults to 30 seconds.
+func WithMaxBackoff(max time.Duration) Option {
+	return func(d *Dispatcher) { d.maxBackoff = max }
+}
+
+// New builds a Dispatcher that publishes payment_events rows via publisher.
+func New(pool *pgxpool.Pool, publisher Publisher, log zerolog.Logger, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		pool:         pool,
+		publisher:    publisher,
+		log:          log,
+		batchSize:    20,
+		pollInterval: time.Second,
+		maxBackoff:   30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Run polls until ctx is canceled. Transient DB errors are retried with
+// exponential backoff; publish failures leave the row unsent so the next
+// poll picks it up again.
+func (d *Dispatcher) Run(ctx context.Context) {
+	backoff := d.pollInterval
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		sent, err := d.dispatchOnce(ctx)
+		if err != nil {
+			d.log.Error().Err(err).Msg(`outbox: poll failed`)
+			backoff *= 2
+			if backoff > d.maxBackoff {
+				backoff = d.maxBackoff
+			}
+			continue
+		}
+
+		backoff = d.pollInterval
+		if sent == 0 {
+			continue
+		}
+	}
+}
+
+func (d *Dispatcher) dispatchOnce(ctx context.Context) (sent int, err error) {
+	err = d.pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted}, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, selectUnsentQuery, d.batchSize)
+		if err != nil {
+			return err
+		}
+
+		var msgs []Message
+		for rows.Next() {
+			var msg Message
+			if err := rows.Scan(&msg.ID, &msg.PaymentID, &msg.CustomerID, &msg.Status, &msg.Payload); err != nil {
+				rows.Close()
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			if err := d.publisher.Publish(ctx, msg); err != nil {
+				d.log.Warn().Err(err).Str(`payment_id`, msg.PaymentID.String()).Msg(`outbox: publish failed, will retry`)
+				continue
+			}
+			if _, err := tx.Exec(ctx, markSentQuery, msg.ID); err != nil {
+				return err
+			}
+			sent++
+		}
+
+		return nil
+	})
+	return sent, err
+}